@@ -0,0 +1,171 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Replication configures automatic cross-bucket replication from this bucket
+// to a destination bucket via Storage Transfer Service. Init expands it into
+// a companion STSTransferJob resource; users don't author that resource
+// directly.
+type Replication struct {
+	DestinationBucket  string   `json:"destinationBucket"`
+	DestinationProject string   `json:"destinationProject"`
+	IncludePrefixes    []string `json:"includePrefixes,omitempty"`
+	ExcludePrefixes    []string `json:"excludePrefixes,omitempty"`
+	// Schedule is a cron-style schedule understood by the generated transfer
+	// job. An empty schedule means "run once".
+	Schedule string `json:"schedule,omitempty"`
+}
+
+// STSTransferJob is the Storage Transfer Service job Init generates to carry
+// out a GCSBucket's Replication config.
+type STSTransferJob struct {
+	JobName            string    `json:"name"`
+	SourceBucket       string    `json:"sourceBucket"`
+	SourceProject      string    `json:"sourceProject"`
+	DestinationBucket  string    `json:"destinationBucket"`
+	DestinationProject string    `json:"destinationProject"`
+	IncludePrefixes    []string  `json:"includePrefixes,omitempty"`
+	ExcludePrefixes    []string  `json:"excludePrefixes,omitempty"`
+	Schedule           string    `json:"schedule,omitempty"`
+	Bindings           []Binding `json:"bindings,omitempty"`
+}
+
+// Name returns the name of the transfer job.
+func (j *STSTransferJob) Name() string {
+	return j.JobName
+}
+
+// TemplatePath returns the name of the template to use for the transfer job.
+func (j *STSTransferJob) TemplatePath() string {
+	return "deploy/config/templates/sts_transfer_job/sts_transfer_job.py"
+}
+
+// initReplication validates the replication target and appends the companion
+// STS transfer job that will actually move data to it, wiring up the STS
+// service agent's read access on the source and write access on the
+// destination.
+func (b *GCSBucket) initReplication(project *Project) error {
+	r := b.Replication
+	if r.DestinationBucket == "" || r.DestinationProject == "" {
+		return errors.New("replication.destinationBucket and replication.destinationProject must be set")
+	}
+
+	dstProject := project
+	if r.DestinationProject != project.ID {
+		dstProject = findProject(project, r.DestinationProject)
+		if dstProject == nil {
+			return fmt.Errorf("replication.destinationProject %q must be declared in the same config as this project so its bucket, CMEK, retention and audit-log settings can be validated", r.DestinationProject)
+		}
+	}
+	dst := findGCSBucket(dstProject, r.DestinationBucket)
+	if dst == nil {
+		return fmt.Errorf("replication.destinationBucket %q not found in project %q", r.DestinationBucket, r.DestinationProject)
+	}
+	if err := validateReplicationTarget(project, dstProject, b, dst); err != nil {
+		return err
+	}
+
+	stsServiceAgent := fmt.Sprintf("project-%s@storage-transfer-service.iam.gserviceaccount.com", project.GeneratedFields.ProjectNumber)
+	b.Bindings = append(b.Bindings, Binding{
+		Role:    "roles/storage.objectViewer",
+		Members: []string{"serviceAccount:" + stsServiceAgent},
+	})
+
+	job := &STSTransferJob{
+		JobName:            fmt.Sprintf("%s-to-%s", b.GCSBucketName, r.DestinationBucket),
+		SourceBucket:       b.GCSBucketName,
+		SourceProject:      project.ID,
+		DestinationBucket:  r.DestinationBucket,
+		DestinationProject: r.DestinationProject,
+		IncludePrefixes:    r.IncludePrefixes,
+		ExcludePrefixes:    r.ExcludePrefixes,
+		Schedule:           r.Schedule,
+		Bindings: []Binding{
+			{Role: "roles/storage.legacyBucketWriter", Members: []string{"serviceAccount:" + stsServiceAgent}},
+		},
+	}
+	project.Resources.STSTransferJob = append(project.Resources.STSTransferJob, job)
+	return nil
+}
+
+// findGCSBucket returns the bucket with the given name declared in project,
+// or nil if none matches.
+func findGCSBucket(project *Project, name string) *GCSBucket {
+	for _, gb := range project.Resources.GCSBucket {
+		if gb.Name() == name {
+			return gb
+		}
+	}
+	return nil
+}
+
+// findProject returns the project with the given ID from project's config,
+// or nil if project's config has no visibility into it (e.g. it isn't
+// declared in the same config file).
+func findProject(project *Project, id string) *Project {
+	if project.Config == nil {
+		return nil
+	}
+	for _, p := range project.Config.Projects {
+		if p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// effectiveRetention returns the retention period b will end up with once its
+// own Init runs: its explicit RetentionPolicy if set, otherwise the HIPAA
+// default initRetentionPolicy would apply. It's used instead of reading
+// b.RetentionPolicy directly because, depending on bucket processing order,
+// b's own Init (and thus initRetentionPolicy) may not have run yet.
+func effectiveRetention(project *Project, b *GCSBucket) time.Duration {
+	if b.RetentionPolicy != nil {
+		return b.RetentionPolicy.RetentionPeriod
+	}
+	if project.HIPAA && project.AuditLogs.LogsGCSBucket != b {
+		return hipaaMinRetentionPeriod
+	}
+	return 0
+}
+
+// validateReplicationTarget fails fast when the destination bucket doesn't
+// meet or exceed the source bucket's compliance posture, rather than letting
+// a DR replica silently weaken it. srcProject and dstProject are consulted
+// (rather than src.Logging.LogBucket/dst.Logging.LogBucket, which Init
+// populates later in its own run and so aren't reliable yet) to check that
+// both buckets share an audit log bucket.
+func validateReplicationTarget(srcProject, dstProject *Project, src, dst *GCSBucket) error {
+	var srcKey, dstKey string
+	if src.Encryption != nil {
+		srcKey = src.Encryption.DefaultKMSKeyName
+	}
+	if dst.Encryption != nil {
+		dstKey = dst.Encryption.DefaultKMSKeyName
+	}
+	if srcKey != "" && dstKey == "" {
+		return fmt.Errorf("replication destination bucket %q must use CMEK to match source bucket %q", dst.GCSBucketName, src.GCSBucketName)
+	}
+
+	srcRetention := effectiveRetention(srcProject, src)
+	dstRetention := effectiveRetention(dstProject, dst)
+	if dstRetention < srcRetention {
+		return fmt.Errorf("replication destination bucket %q retention (%s) must be at least as long as source bucket %q retention (%s)", dst.GCSBucketName, dstRetention, src.GCSBucketName, srcRetention)
+	}
+
+	var srcLogBucket, dstLogBucket string
+	if srcProject.AuditLogs.LogsGCSBucket != nil {
+		srcLogBucket = srcProject.AuditLogs.LogsGCSBucket.Name()
+	}
+	if dstProject.AuditLogs.LogsGCSBucket != nil {
+		dstLogBucket = dstProject.AuditLogs.LogsGCSBucket.Name()
+	}
+	if srcLogBucket == "" || srcLogBucket != dstLogBucket {
+		return fmt.Errorf("replication destination bucket %q (project %q) must share the same audit log bucket as source bucket %q (project %q)", dst.GCSBucketName, dstProject.ID, src.GCSBucketName, srcProject.ID)
+	}
+	return nil
+}
@@ -4,31 +4,94 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 )
 
 // GCSBucket wraps a CFT Cloud Storage Bucket.
 type GCSBucket struct {
 	GCSBucketProperties `json:"properties"`
-	TTLDays             int      `json:"ttl_days,omitempty"`
-	ExpectedUsers       []string `json:"expected_users,omitempty"`
+	TTLDays             int          `json:"ttl_days,omitempty"`
+	ExpectedUsers       []string     `json:"expected_users,omitempty"`
+	Replication         *Replication `json:"replication,omitempty"`
 	raw                 json.RawMessage
 }
 
 // GCSBucketProperties  represents a partial CFT bucket implementation.
 type GCSBucketProperties struct {
-	GCSBucketName              string     `json:"name"`
-	Location                   string     `json:"location"`
-	Bindings                   []Binding  `json:"bindings"`
-	StorageClass               string     `json:"storageClass,omitempty"`
-	Versioning                 versioning `json:"versioning"`
-	Lifecycle                  *lifecycle `json:"lifecycle,omitempty"`
-	PredefinedACL              string     `json:"predefinedAcl,omitempty"`
-	PredefinedDefaultObjectACL string     `json:"predefinedDefaultObjectAcl,omitempty"`
-	Logging                    struct {
+	GCSBucketName              string      `json:"name"`
+	Location                   string      `json:"location"`
+	Bindings                   []Binding   `json:"bindings"`
+	StorageClass               string      `json:"storageClass,omitempty"`
+	Versioning                 versioning  `json:"versioning"`
+	Lifecycle                  *lifecycle  `json:"lifecycle,omitempty"`
+	PredefinedACL              string      `json:"predefinedAcl,omitempty"`
+	PredefinedDefaultObjectACL string      `json:"predefinedDefaultObjectAcl,omitempty"`
+	Encryption                 *encryption `json:"encryption,omitempty"`
+	// KMSKeyBindings holds the IAM bindings the template must grant on the
+	// referenced CMEK key (as opposed to Bindings, which apply to the bucket
+	// itself). Init populates this automatically; it is not user-settable.
+	KMSKeyBindings []Binding `json:"kmsKeyBindings,omitempty"`
+	Billing        billing   `json:"billing,omitempty"`
+	// UserProject is billed for requests against this bucket (and its
+	// objects) instead of the bucket's own project. It is required when
+	// Billing.RequesterPays is enabled.
+	UserProject string `json:"userProject,omitempty"`
+	// ServiceUsageBindings holds the roles/serviceusage.serviceUsageConsumer
+	// binding the template must grant on UserProject so its members may be
+	// billed for requester-pays access. Init populates this automatically; it
+	// is not user-settable.
+	ServiceUsageBindings  []Binding         `json:"serviceUsageBindings,omitempty"`
+	RetentionPolicy       *retentionPolicy  `json:"retentionPolicy,omitempty"`
+	EventBasedHold        bool              `json:"eventBasedHold,omitempty"`
+	DefaultEventBasedHold bool              `json:"defaultEventBasedHold,omitempty"`
+	IamConfiguration      *iamConfiguration `json:"iamConfiguration,omitempty"`
+	Logging               struct {
 		LogBucket string `json:"logBucket"`
 	} `json:"logging"`
 }
 
+type iamConfiguration struct {
+	UniformBucketLevelAccess struct {
+		// Use pointer to differentiate between zero value and intentionally being set to false.
+		Enabled *bool `json:"enabled"`
+	} `json:"uniformBucketLevelAccess,omitempty"`
+	// PublicAccessPrevention is "enforced" or "inherited".
+	PublicAccessPrevention string `json:"publicAccessPrevention,omitempty"`
+}
+
+// hipaaMinRetentionPeriod is the minimum default retention period (6 years)
+// required by Init on data buckets in HIPAA-scoped projects.
+const hipaaMinRetentionPeriod = 2190 * 24 * time.Hour
+
+type retentionPolicy struct {
+	RetentionPeriod time.Duration `json:"retentionPeriod"`
+	// IsLocked permanently locks the retention policy once applied: neither
+	// the period nor the lock itself can ever be reversed. Double-check
+	// RetentionPeriod before setting this.
+	IsLocked bool `json:"isLocked,omitempty"`
+}
+
+type billing struct {
+	// RequesterPays, when true, requires the requester to provide a
+	// UserProject to be billed for data access and network egress.
+	RequesterPays bool `json:"requesterPays,omitempty"`
+}
+
+type encryption struct {
+	// DefaultKMSKeyName is the fully-qualified Cloud KMS CryptoKey name used to
+	// encrypt objects written to this bucket, e.g.
+	// projects/p/locations/us/keyRings/kr/cryptoKeys/k.
+	DefaultKMSKeyName string `json:"defaultKmsKeyName,omitempty"`
+}
+
+// kmsKeyNameRE matches a fully-qualified Cloud KMS CryptoKey resource name and
+// captures its location.
+var kmsKeyNameRE = regexp.MustCompile(`^projects/[^/]+/locations/([^/]+)/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+
 type versioning struct {
 	// Use pointer to differentiate between zero value and intentionally being set to false.
 	Enabled *bool `json:"enabled"`
@@ -48,11 +111,42 @@ type LifecycleRule struct {
 
 type action struct {
 	Type string `json:"type,omitempty"`
+	// StorageClass is the target storage class for a SetStorageClass action.
+	StorageClass string `json:"storageClass,omitempty"`
 }
 
+// withState mirrors the GCS lifecycle condition.withState enum and supersedes
+// the deprecated boolean IsLive condition.
+type withState string
+
+const (
+	withStateLive     withState = "LIVE"
+	withStateArchived withState = "ARCHIVED"
+	withStateAny      withState = "ANY"
+)
+
 type condition struct {
-	Age    int  `json:"age,omitempty"`
-	IsLive bool `json:"isLive,omitempty"`
+	Age int `json:"age,omitempty"`
+	// IsLive is deprecated in favor of WithState; it is kept for backwards
+	// compatibility with existing user configs.
+	IsLive                  bool      `json:"isLive,omitempty"`
+	WithState               withState `json:"withState,omitempty"`
+	CreatedBefore           string    `json:"createdBefore,omitempty"`
+	CustomTimeBefore        string    `json:"customTimeBefore,omitempty"`
+	DaysSinceCustomTime     int       `json:"daysSinceCustomTime,omitempty"`
+	DaysSinceNoncurrentTime int       `json:"daysSinceNoncurrentTime,omitempty"`
+	NoncurrentTimeBefore    string    `json:"noncurrentTimeBefore,omitempty"`
+	NumNewerVersions        int       `json:"numNewerVersions,omitempty"`
+	MatchesStorageClass     []string  `json:"matchesStorageClass,omitempty"`
+}
+
+// storageClassRank orders storage classes from hottest to coldest so
+// SetStorageClass transitions can be checked for monotonicity.
+var storageClassRank = map[string]int{
+	"STANDARD": 0,
+	"NEARLINE": 1,
+	"COLDLINE": 2,
+	"ARCHIVE":  3,
 }
 
 // aliasGCSBucket is used to prevent infinite recursion when dealing with json marshaling.
@@ -91,6 +185,33 @@ func (b *GCSBucket) Init(project *Project) error {
 	if b.PredefinedACL != "" || b.PredefinedDefaultObjectACL != "" {
 		return errors.New("predefined ACLs must not be set")
 	}
+	if len(b.KMSKeyBindings) > 0 {
+		return errors.New("kmsKeyBindings is populated by Init and must not be set by the user")
+	}
+	if len(b.ServiceUsageBindings) > 0 {
+		return errors.New("serviceUsageBindings is populated by Init and must not be set by the user")
+	}
+	if b.Encryption != nil {
+		if err := b.initEncryption(project); err != nil {
+			return err
+		}
+	}
+	if b.Billing.RequesterPays {
+		if err := b.initRequesterPays(project); err != nil {
+			return err
+		}
+	}
+	if err := b.initRetentionPolicy(project); err != nil {
+		return err
+	}
+	if err := b.initIamConfiguration(project); err != nil {
+		return err
+	}
+	if b.Replication != nil {
+		if err := b.initReplication(project); err != nil {
+			return err
+		}
+	}
 
 	t := true
 	b.Versioning.Enabled = &t
@@ -132,11 +253,182 @@ func (b *GCSBucket) Init(project *Project) error {
 		if b.Lifecycle == nil {
 			b.Lifecycle = &lifecycle{}
 		}
+		// WithState=ANY (rather than IsLive=true) so noncurrent versions are
+		// also expired once they reach TTLDays.
 		b.Lifecycle.Rules = append(b.Lifecycle.Rules, &LifecycleRule{
 			Action:    &action{Type: "Delete"},
-			Condition: &condition{Age: b.TTLDays, IsLive: true},
+			Condition: &condition{Age: b.TTLDays, WithState: withStateAny},
 		})
 	}
+	if err := b.validateLifecycle(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateLifecycle checks that lifecycle rules cannot cause silent data loss
+// and that SetStorageClass transitions, ordered by age, never move to a
+// warmer storage class than an earlier transition.
+func (b *GCSBucket) validateLifecycle() error {
+	if b.Lifecycle == nil {
+		return nil
+	}
+
+	var transitions []storageClassTransition
+	for _, r := range b.Lifecycle.Rules {
+		if r.Action == nil || r.Condition == nil {
+			continue
+		}
+		isLive := r.Condition.WithState == withStateLive || r.Condition.IsLive
+		if r.Action.Type == "Delete" && isLive && r.Condition.NumNewerVersions == 0 {
+			return errors.New("a Delete rule with withState=LIVE on a versioned bucket must set numNewerVersions to avoid deleting the only live copy of an object")
+		}
+		if r.Action.Type == "SetStorageClass" {
+			rank, ok := storageClassRank[r.Action.StorageClass]
+			if !ok {
+				return fmt.Errorf("lifecycle rule has unknown target storage class %q", r.Action.StorageClass)
+			}
+			transitions = append(transitions, storageClassTransition{age: r.Condition.Age, rank: rank, storageClass: r.Action.StorageClass})
+		}
+	}
+
+	// Rules are evaluated by GCS against their own condition (age here), not
+	// by their declaration order in the array, so sort by age before checking
+	// monotonicity. SliceStable (plus the explicit same-age check below) keeps
+	// the result deterministic when two rules share an age.
+	sort.SliceStable(transitions, func(i, j int) bool { return transitions[i].age < transitions[j].age })
+	lastAge, lastRank := -1, -1
+	for _, t := range transitions {
+		if t.age == lastAge {
+			return fmt.Errorf("lifecycle has conflicting SetStorageClass rules both triggered at age %d", t.age)
+		}
+		if t.rank < lastRank {
+			return fmt.Errorf("lifecycle SetStorageClass rules must transition STANDARD->NEARLINE->COLDLINE->ARCHIVE with increasing age, not downgrade to %q", t.storageClass)
+		}
+		lastAge, lastRank = t.age, t.rank
+	}
+	return nil
+}
+
+// storageClassTransition is a single SetStorageClass rule's trigger age and
+// target storage class rank, used to check transitions are monotonic.
+type storageClassTransition struct {
+	age          int
+	rank         int
+	storageClass string
+}
+
+// initEncryption validates the CMEK configuration and grants the project's
+// GCS service account permission to use the referenced key.
+func (b *GCSBucket) initEncryption(project *Project) error {
+	m := kmsKeyNameRE.FindStringSubmatch(b.Encryption.DefaultKMSKeyName)
+	if m == nil {
+		return fmt.Errorf("encryption.defaultKmsKeyName %q must be a fully-qualified projects/*/locations/*/keyRings/*/cryptoKeys/* path", b.Encryption.DefaultKMSKeyName)
+	}
+	if !strings.EqualFold(m[1], b.Location) {
+		return fmt.Errorf("encryption.defaultKmsKeyName is in location %q, which does not match bucket location %q", m[1], b.Location)
+	}
+
+	gcsServiceAccount := fmt.Sprintf("service-%s@gs-project-accounts.iam.gserviceaccount.com", project.GeneratedFields.ProjectNumber)
+	b.KMSKeyBindings = append(b.KMSKeyBindings, Binding{
+		Role:    "roles/cloudkms.cryptoKeyEncrypterDecrypter",
+		Members: []string{"serviceAccount:" + gcsServiceAccount},
+	})
+	return nil
+}
+
+// initRequesterPays validates requester-pays billing and grants the bucket's
+// authorized readers/writers permission to be billed via UserProject.
+func (b *GCSBucket) initRequesterPays(project *Project) error {
+	if project.AuditLogs.LogsGCSBucket == b {
+		return errors.New("requester pays must not be enabled on the audit log bucket")
+	}
+	if len(project.DataReadOnlyGroups) == 0 && len(project.DataReadWriteGroups) == 0 {
+		return errors.New("requester pays requires DataReadOnlyGroups or DataReadWriteGroups to be set")
+	}
+	if b.UserProject == "" {
+		return errors.New("userProject must be set when requester pays is enabled")
+	}
+
+	appendGroupPrefix := func(ss ...string) []string {
+		res := make([]string, 0, len(ss))
+		for _, s := range ss {
+			res = append(res, "group:"+s)
+		}
+		return res
+	}
+	members := appendGroupPrefix(append(append([]string{}, project.DataReadOnlyGroups...), project.DataReadWriteGroups...)...)
+	b.ServiceUsageBindings = append(b.ServiceUsageBindings, Binding{
+		Role:    "roles/serviceusage.serviceUsageConsumer",
+		Members: members,
+	})
+	return nil
+}
+
+// initRetentionPolicy validates the bucket's retention policy against its
+// lifecycle rules and applies the HIPAA default retention to data buckets
+// that don't declare one.
+//
+// The template applies RetentionPolicy in two steps when IsLocked is set:
+// it first creates/updates the (unlocked) retention policy, then issues a
+// separate lockRetentionPolicy call as a follow-up action, so plan/apply
+// tooling can preview the lock before it irreversibly fires.
+func (b *GCSBucket) initRetentionPolicy(project *Project) error {
+	isDataBucket := project.AuditLogs.LogsGCSBucket != b
+	if b.RetentionPolicy == nil {
+		if project.HIPAA && isDataBucket {
+			b.RetentionPolicy = &retentionPolicy{RetentionPeriod: hipaaMinRetentionPeriod}
+		}
+		return nil
+	}
+	if b.RetentionPolicy.IsLocked {
+		log.Printf("warning: bucket %q sets retentionPolicy.isLocked=true; this cannot be undone once applied", b.GCSBucketName)
+	}
+
+	longestTTL := b.TTLDays
+	if b.Lifecycle != nil {
+		for _, r := range b.Lifecycle.Rules {
+			if r.Action != nil && r.Condition != nil && r.Action.Type == "Delete" && r.Condition.Age > longestTTL {
+				longestTTL = r.Condition.Age
+			}
+		}
+	}
+	if b.RetentionPolicy.IsLocked && longestTTL > 0 && b.RetentionPolicy.RetentionPeriod > time.Duration(longestTTL)*24*time.Hour {
+		return fmt.Errorf("retentionPolicy.retentionPeriod (%s) must not exceed the longest lifecycle TTL (%d days); a locked retention policy would otherwise permanently block that scheduled deletion", b.RetentionPolicy.RetentionPeriod, longestTTL)
+	}
+	if project.HIPAA && isDataBucket && b.RetentionPolicy.RetentionPeriod < hipaaMinRetentionPeriod {
+		return fmt.Errorf("retentionPolicy.retentionPeriod must be at least %s on data buckets in HIPAA-scoped projects", hipaaMinRetentionPeriod)
+	}
+	return nil
+}
+
+// initIamConfiguration defaults uniform bucket-level access on for regulated
+// projects and rejects public bindings once UBLA or public-access-prevention
+// is in effect.
+func (b *GCSBucket) initIamConfiguration(project *Project) error {
+	if b.IamConfiguration == nil {
+		if !project.HIPAA {
+			return nil
+		}
+		b.IamConfiguration = &iamConfiguration{}
+	}
+	if b.IamConfiguration.UniformBucketLevelAccess.Enabled == nil && project.HIPAA {
+		t := true
+		b.IamConfiguration.UniformBucketLevelAccess.Enabled = &t
+	}
+
+	ublaEnabled := b.IamConfiguration.UniformBucketLevelAccess.Enabled != nil && *b.IamConfiguration.UniformBucketLevelAccess.Enabled
+	papEnforced := b.IamConfiguration.PublicAccessPrevention == "enforced"
+	if !ublaEnabled && !papEnforced {
+		return nil
+	}
+	for _, binding := range b.Bindings {
+		for _, m := range binding.Members {
+			if m == "allUsers" || m == "allAuthenticatedUsers" {
+				return fmt.Errorf("bindings must not grant %q when uniform bucket-level access or public access prevention is enabled", m)
+			}
+		}
+	}
 	return nil
 }
 
@@ -169,5 +461,50 @@ func (b *GCSBucket) UnmarshalJSON(data []byte) error {
 // MarshalJSON provides a custom JSON marshaller.
 // It is used to merge the original (raw) user JSON definition with the struct.
 func (b *GCSBucket) MarshalJSON() ([]byte, error) {
-	return interfacePair{b.raw, aliasGCSBucket(*b)}.MarshalJSON()
+	raw := b.raw
+	if b.IamConfiguration != nil && b.IamConfiguration.UniformBucketLevelAccess.Enabled != nil && *b.IamConfiguration.UniformBucketLevelAccess.Enabled {
+		var err error
+		raw, err = stripRawProperty(raw, "acl", "defaultObjectAcl")
+		if err != nil {
+			return nil, fmt.Errorf("failed to strip per-object ACL grants invalid under uniform bucket-level access: %v", err)
+		}
+	}
+	return interfacePair{raw, aliasGCSBucket(*b)}.MarshalJSON()
+}
+
+// stripRawProperty removes the given keys from the "properties" object of a
+// raw GCSBucket JSON document, if present. It is used to drop fields from the
+// user's original JSON that would otherwise survive the raw/struct merge.
+func stripRawProperty(raw json.RawMessage, keys ...string) (json.RawMessage, error) {
+	if len(raw) == 0 {
+		return raw, nil
+	}
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &top); err != nil {
+		return nil, err
+	}
+	propsRaw, ok := top["properties"]
+	if !ok {
+		return raw, nil
+	}
+	var props map[string]json.RawMessage
+	if err := json.Unmarshal(propsRaw, &props); err != nil {
+		return nil, err
+	}
+	changed := false
+	for _, k := range keys {
+		if _, ok := props[k]; ok {
+			delete(props, k)
+			changed = true
+		}
+	}
+	if !changed {
+		return raw, nil
+	}
+	newProps, err := json.Marshal(props)
+	if err != nil {
+		return nil, err
+	}
+	top["properties"] = newProps
+	return json.Marshal(top)
 }